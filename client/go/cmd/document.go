@@ -0,0 +1,578 @@
+// Copyright Verizon Media. Licensed under the terms of the Apache 2.0 license. See LICENSE in the project root.
+// document command
+// Author: bratseth
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/vespa-engine/vespa/util"
+	"github.com/vespa-engine/vespa/vespa"
+)
+
+// exitClient, exitServer and exitLocalIO are the process exit codes used for
+// the three kinds of failure a document command can have.
+const (
+	exitClient  = 1
+	exitServer  = 2
+	exitLocalIO = 3
+)
+
+// osExit is a var so tests can observe the requested exit code instead of
+// actually terminating the test binary.
+var osExit = os.Exit
+
+// errOut is where --json-errors payloads are written; a var so tests can
+// capture it.
+var errOut io.Writer = os.Stderr
+
+// documentError is an error from a document operation that knows which
+// process exit code it should result in, and can be rendered as a
+// structured --json-errors payload.
+type documentError struct {
+	exitCode   int
+	status     int
+	message    string
+	documentId string
+}
+
+func (e *documentError) Error() string { return e.message }
+
+func clientError(documentId string, format string, args ...interface{}) *documentError {
+	return &documentError{exitCode: exitClient, documentId: documentId, message: fmt.Sprintf(format, args...)}
+}
+
+func ioError(format string, args ...interface{}) *documentError {
+	return &documentError{exitCode: exitLocalIO, message: fmt.Sprintf(format, args...)}
+}
+
+const documentTimeout = 30 * time.Second
+
+const documentContext = "document"
+
+var documentCondition string
+var documentCreate bool
+var feedConcurrency int
+var documentFields string
+var documentFormat string
+var documentOutput string
+var jsonErrors bool
+
+func init() {
+	rootCmd.AddCommand(documentCmd)
+	documentCmd.AddCommand(documentPostCmd)
+	documentCmd.AddCommand(documentPutCmd)
+	documentCmd.AddCommand(documentGetCmd)
+	documentCmd.AddCommand(documentRemoveCmd)
+	documentCmd.AddCommand(documentFeedCmd)
+
+	documentCmd.PersistentFlags().BoolVar(&jsonErrors, "json-errors", false,
+		"On failure, write a structured JSON error to stderr instead of a plain text message")
+
+	documentFeedCmd.Flags().IntVar(&feedConcurrency, "concurrency", 8,
+		"The number of feed operations to have in flight at once")
+
+	documentGetCmd.Flags().StringVar(&documentFields, "fields", "",
+		"A comma-separated list of fields to retrieve, instead of the whole document")
+	documentGetCmd.Flags().StringVar(&documentFormat, "format", "pretty",
+		"The output format to use: 'pretty' (indented JSON) or 'raw' (verbatim response body)")
+	documentGetCmd.Flags().StringVar(&documentOutput, "output", "",
+		"File to write the document to, instead of stdout")
+
+	for _, writeCmd := range []*cobra.Command{documentPostCmd, documentPutCmd, documentRemoveCmd} {
+		writeCmd.PersistentFlags().StringVar(&documentCondition, "condition", "",
+			"A test-and-set condition that must match the existing document for the write to be applied")
+	}
+	documentPostCmd.PersistentFlags().BoolVar(&documentCreate, "create", false,
+		"Create the document if it does not already exist")
+	documentPutCmd.PersistentFlags().BoolVar(&documentCreate, "create", false,
+		"Create the document if it does not already exist")
+}
+
+var documentCmd = &cobra.Command{
+	Use:   "document [id] json-file",
+	Short: "Writes a document to Vespa (short-hand for 'vespa document post')",
+	Long: `Writes the document in the given JSON file to Vespa.
+
+The document id may be given as an argument, or as a "put" key inside the
+JSON file. This is a short-hand for 'vespa document post'.`,
+	Args: cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		printResult(documentSend(http.MethodPost, "put", args))
+	},
+}
+
+var documentPostCmd = &cobra.Command{
+	Use:   "post [id] json-file",
+	Short: "Writes a document to Vespa",
+	Long: `Writes the document in the given JSON file to Vespa.
+
+The document id may be given as an argument, or as a "put" key inside the
+JSON file.`,
+	Args: cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		printResult(documentSend(http.MethodPost, "put", args))
+	},
+}
+
+var documentPutCmd = &cobra.Command{
+	Use:   "put [id] json-file",
+	Short: "Partially updates a document in Vespa",
+	Long: `Sends a partial update, as described in the given JSON file, to Vespa.
+
+The document id may be given as an argument, or as an "update" key inside
+the JSON file.`,
+	Args: cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		printResult(documentSend(http.MethodPut, "update", args))
+	},
+}
+
+var documentGetCmd = &cobra.Command{
+	Use:   "get id",
+	Short: "Gets a document from Vespa",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		printResult(documentGet(args[0]))
+	},
+}
+
+var documentRemoveCmd = &cobra.Command{
+	Use:   "remove id",
+	Short: "Removes a document from Vespa",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		printResult(documentRemove(args[0]))
+	},
+}
+
+var documentFeedCmd = &cobra.Command{
+	Use:   "feed file-or-dir",
+	Short: "Feeds a stream of document operations to Vespa",
+	Long: `Feeds put, update and remove operations, read from the given file or
+directory, to Vespa.
+
+The input is either newline-delimited JSON (one operation per line) or a
+single JSON array of operations. Each operation is a JSON object carrying
+the operation type ("put", "update" or "remove") and document id as a
+top-level key: a "put" object is in the form read by 'vespa document post',
+an "update" object in the form read by 'vespa document put', and a "remove"
+object needs only its "remove" key. If a directory is given, every *.json
+file in it is fed, in sorted order.
+
+Feeding is done by a pool of --concurrency workers, and operations that
+fail with a 429 or 503 status are retried with exponential backoff.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		printResult(documentFeed(args[0]))
+	},
+}
+
+// feedOperation is a single put/update/remove read from a feed file.
+type feedOperation struct {
+	method     string
+	documentId string
+	data       []byte
+}
+
+const (
+	feedMaxAttempts    = 5
+	feedInitialBackoff = 200 * time.Millisecond
+)
+
+// documentFeed reads every operation in path and sends it to Vespa using a
+// pool of feedConcurrency workers, returning a summary on success.
+func documentFeed(path string) (string, error) {
+	operations, err := readFeedOperations(path)
+	if err != nil {
+		return "", err
+	}
+
+	concurrency := feedConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	jobs := make(chan feedOperation)
+	errs := make(chan error)
+
+	var workers sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for op := range jobs {
+				errs <- sendFeedOperation(op)
+			}
+		}()
+	}
+	go func() {
+		workers.Wait()
+		close(errs)
+	}()
+	go func() {
+		for _, op := range operations {
+			jobs <- op
+		}
+		close(jobs)
+	}()
+
+	start := time.Now()
+	var ok, failed int
+	for err := range errs {
+		if err != nil {
+			failed++
+			fmt.Fprintln(os.Stderr, "Error:", err)
+		} else {
+			ok++
+		}
+		elapsed := time.Since(start).Seconds()
+		rate := float64(ok+failed) / elapsed
+		fmt.Fprintf(os.Stderr, "\r%d/%d documents fed, %d failed (%.1f docs/sec)",
+			ok+failed, len(operations), failed, rate)
+	}
+	fmt.Fprintln(os.Stderr)
+
+	if failed > 0 {
+		return "", clientError("", "Fed %d documents, %d failed", ok, failed)
+	}
+	return fmt.Sprintf("Success: Fed %d documents", ok), nil
+}
+
+// sendFeedOperation sends a single feed operation, retrying with exponential
+// backoff, up to feedMaxAttempts attempts in all, while the request fails
+// without a response or the response status is 429 (Too Many Requests) or 503
+// (Service Unavailable).
+func sendFeedOperation(op feedOperation) error {
+	url, err := documentUrl(op.documentId)
+	if err != nil {
+		return err
+	}
+
+	backoff := feedInitialBackoff
+	var lastErr error
+	for attempt := 0; attempt < feedMaxAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		request := &http.Request{Method: op.method, URL: url}
+		if op.method != http.MethodDelete {
+			request.Header = map[string][]string{"Content-Type": {"application/json"}}
+			request.Body = ioutil.NopCloser(bytes.NewReader(op.data))
+		}
+
+		response, err := httpClient.Do(request, documentTimeout)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		status := response.StatusCode
+		lastErr = checkDocumentResponse(response, op.documentId)
+		response.Body.Close()
+		if lastErr == nil {
+			return nil
+		}
+		if status != http.StatusTooManyRequests && status != http.StatusServiceUnavailable {
+			return lastErr
+		}
+	}
+	return lastErr
+}
+
+// readFeedOperations reads every operation found in path, which is either a
+// single feed file or a directory of *.json feed files.
+func readFeedOperations(path string) ([]feedOperation, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, ioError("Could not read '%s': %v", path, err)
+	}
+
+	files := []string{path}
+	if info.IsDir() {
+		files = nil
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			return nil, ioError("Could not read directory '%s': %v", path, err)
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".json") {
+				files = append(files, filepath.Join(path, entry.Name()))
+			}
+		}
+		sort.Strings(files)
+	}
+
+	var operations []feedOperation
+	for _, file := range files {
+		fileOperations, err := parseFeedFile(file)
+		if err != nil {
+			return nil, err
+		}
+		operations = append(operations, fileOperations...)
+	}
+	return operations, nil
+}
+
+// parseFeedFile parses file as either newline-delimited JSON or a single
+// JSON array of feed operations.
+func parseFeedFile(file string) ([]feedOperation, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, ioError("Could not read file '%s': %v", file, err)
+	}
+
+	var rawOperations []json.RawMessage
+	trimmed := bytes.TrimSpace(content)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &rawOperations); err != nil {
+			return nil, clientError("", "Invalid feed file '%s': %v", file, err)
+		}
+	} else {
+		for _, line := range strings.Split(string(trimmed), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" {
+				continue
+			}
+			rawOperations = append(rawOperations, json.RawMessage(line))
+		}
+	}
+
+	operations := make([]feedOperation, 0, len(rawOperations))
+	for _, raw := range rawOperations {
+		op, err := feedOperationFrom(raw)
+		if err != nil {
+			return nil, clientError("", "Invalid operation in '%s': %v", file, err)
+		}
+		operations = append(operations, op)
+	}
+	return operations, nil
+}
+
+// feedOperationFrom determines the verb and document id of a feed operation
+// from its top-level "put", "update" or "remove" key.
+func feedOperationFrom(raw json.RawMessage) (feedOperation, error) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return feedOperation{}, err
+	}
+	for key, method := range map[string]string{
+		"put":    http.MethodPost,
+		"update": http.MethodPut,
+		"remove": http.MethodDelete,
+	} {
+		if id, ok := fields[key].(string); ok {
+			return feedOperation{method: method, documentId: id, data: []byte(raw)}, nil
+		}
+	}
+	return feedOperation{}, errors.New("no 'put', 'update' or 'remove' key found")
+}
+
+// documentSend implements both 'document post' (operationKey "put") and
+// 'document put' (operationKey "update"), which only differ in HTTP method
+// and the JSON key documents use to carry their id.
+func documentSend(method string, operationKey string, args []string) (string, error) {
+	var documentId, jsonFile string
+	if len(args) == 1 {
+		jsonFile = args[0]
+	} else {
+		documentId = args[0]
+		jsonFile = args[1]
+	}
+
+	documentData, err := ioutil.ReadFile(jsonFile)
+	if err != nil {
+		return "", ioError("Could not read file '%s': %v", jsonFile, err)
+	}
+
+	if documentId == "" {
+		documentId, err = idFromDocumentJson(documentData, operationKey)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	url, err := documentUrl(documentId)
+	if err != nil {
+		return "", err
+	}
+
+	response, err := httpClient.Do(&http.Request{
+		Method: method,
+		URL:    url,
+		Header: map[string][]string{"Content-Type": {"application/json"}},
+		Body:   ioutil.NopCloser(strings.NewReader(string(documentData))),
+	}, documentTimeout)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if err := checkDocumentResponse(response, documentId); err != nil {
+		return "", err
+	}
+	return "Success: Wrote " + documentId, nil
+}
+
+func documentGet(documentId string) (string, error) {
+	if documentFormat != "pretty" && documentFormat != "raw" {
+		return "", clientError(documentId, "Invalid format '%s': must be 'pretty' or 'raw'", documentFormat)
+	}
+
+	url, err := documentUrl(documentId)
+	if err != nil {
+		return "", err
+	}
+	if documentFields != "" {
+		query := url.Query()
+		query.Set("fieldSet", "[name]:"+documentFields)
+		url.RawQuery = query.Encode()
+	}
+
+	response, err := httpClient.Do(&http.Request{Method: "GET", URL: url}, documentTimeout)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if err := checkDocumentResponse(response, documentId); err != nil {
+		return "", err
+	}
+	body := util.ReaderToString(response.Body)
+
+	output := body
+	if documentFormat == "pretty" {
+		var indented bytes.Buffer
+		if err := json.Indent(&indented, []byte(body), "", "    "); err == nil {
+			output = indented.String()
+		}
+	}
+
+	if documentOutput != "" {
+		if err := ioutil.WriteFile(documentOutput, []byte(output+"\n"), 0644); err != nil {
+			return "", ioError("Could not write to '%s': %v", documentOutput, err)
+		}
+		return "Success: Wrote " + documentOutput, nil
+	}
+	return output, nil
+}
+
+func documentRemove(documentId string) (string, error) {
+	url, err := documentUrl(documentId)
+	if err != nil {
+		return "", err
+	}
+	response, err := httpClient.Do(&http.Request{Method: "DELETE", URL: url}, documentTimeout)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if err := checkDocumentResponse(response, documentId); err != nil {
+		return "", err
+	}
+	return "Success: Removed " + documentId, nil
+}
+
+// documentUrl resolves the /document/v1/ URL for documentId, including the
+// 'condition' and 'create' query parameters when set.
+func documentUrl(documentId string) (*url.URL, error) {
+	path, err := vespa.IdToURLPath(documentId)
+	if err != nil {
+		return nil, clientError(documentId, "Invalid document id '%s': %v", documentId, err)
+	}
+	target := getTarget(documentContext).document + "/document/v1/" + path
+
+	query := url.Values{}
+	if documentCondition != "" {
+		query.Set("condition", documentCondition)
+	}
+	if documentCreate {
+		query.Set("create", "true")
+	}
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	return url.Parse(target)
+}
+
+func idFromDocumentJson(documentData []byte, operationKey string) (string, error) {
+	var document map[string]interface{}
+	if err := json.Unmarshal(documentData, &document); err != nil {
+		return "", clientError("", "Document is not valid JSON: %v", err)
+	}
+	id, ok := document[operationKey].(string)
+	if !ok || id == "" {
+		return "", clientError("", "No document id given neither as argument or as a '%s' key in the json file", operationKey)
+	}
+	return id, nil
+}
+
+// checkDocumentResponse turns a non-2xx /document/v1/ response into a
+// documentError, distinguishing document-level errors (4xx, e.g. 412 on a
+// failed condition) from container errors (5xx).
+func checkDocumentResponse(response *http.Response, documentId string) error {
+	if response.StatusCode/100 == 2 {
+		return nil
+	}
+	body := util.ReaderToString(response.Body)
+	if response.StatusCode/100 == 5 {
+		return &documentError{
+			exitCode:   exitServer,
+			status:     response.StatusCode,
+			documentId: documentId,
+			message: fmt.Sprintf("Container (document API) at %s: Status %d\n\n%s",
+				response.Request.URL.Host, response.StatusCode, body),
+		}
+	}
+	return &documentError{
+		exitCode:   exitClient,
+		status:     response.StatusCode,
+		documentId: documentId,
+		message:    fmt.Sprintf("Invalid document: Status %d\n\n%s", response.StatusCode, body),
+	}
+}
+
+// jsonError is the --json-errors payload written to errOut on failure.
+type jsonError struct {
+	Status     int    `json:"status"`
+	Message    string `json:"message"`
+	DocumentId string `json:"documentId,omitempty"`
+}
+
+func printResult(result string, err error) {
+	if err != nil {
+		exitCode := exitClient
+		var docErr *documentError
+		if errors.As(err, &docErr) {
+			exitCode = docErr.exitCode
+		}
+		if jsonErrors {
+			payload := jsonError{Message: err.Error()}
+			if docErr != nil {
+				payload.Status = docErr.status
+				payload.DocumentId = docErr.documentId
+			}
+			encoded, _ := json.Marshal(payload)
+			fmt.Fprintln(errOut, string(encoded))
+		} else {
+			fmt.Fprintln(stdout, "Error:", err)
+		}
+		osExit(exitCode)
+		return
+	}
+	fmt.Fprintln(stdout, result)
+}
@@ -5,8 +5,11 @@
 package cmd
 
 import (
+	"bytes"
+	"encoding/json"
 	"io/ioutil"
 	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -32,9 +35,14 @@ func TestDocumentPostWithIdInDocumentShortForm(t *testing.T) {
 func TestDocumentPostIdNotSpecified(t *testing.T) {
 	arguments := []string{"document", "post", "testdata/A-Head-Full-of-Dreams-Without-Id.json"}
 	client := &mockHttpClient{}
+	var output string
+	exitCode := withCapturedExit(t, func() {
+		output = executeCommand(t, client, arguments, []string{})
+	})
 	assert.Equal(t,
 		"Error: No document id given neither as argument or as a 'put' key in the json file\n",
-		executeCommand(t, client, arguments, []string{}))
+		output)
+	assert.Equal(t, 1, exitCode)
 }
 
 func TestDocumentPostDocumentError(t *testing.T) {
@@ -50,6 +58,179 @@ func TestDocumentGet(t *testing.T) {
 		"id:mynamespace:music::a-head-full-of-dreams", t)
 }
 
+func TestDocumentPutWithIdArg(t *testing.T) {
+	assertDocumentPut([]string{"document", "put", "id:mynamespace:music::a-head-full-of-dreams", "testdata/A-Head-Full-of-Dreams-Update.json"},
+		"id:mynamespace:music::a-head-full-of-dreams", "testdata/A-Head-Full-of-Dreams-Update.json", t)
+}
+
+func TestDocumentPutWithIdInDocument(t *testing.T) {
+	assertDocumentPut([]string{"document", "put", "testdata/A-Head-Full-of-Dreams-Update.json"},
+		"id:mynamespace:music::a-head-full-of-dreams", "testdata/A-Head-Full-of-Dreams-Update.json", t)
+}
+
+func TestDocumentRemove(t *testing.T) {
+	assertDocumentRemove([]string{"document", "remove", "id:mynamespace:music::a-head-full-of-dreams"},
+		"id:mynamespace:music::a-head-full-of-dreams", t)
+}
+
+func TestDocumentPostWithCondition(t *testing.T) {
+	client := &mockHttpClient{}
+	assert.Equal(t,
+		"Success: Wrote id:mynamespace:music::a-head-full-of-dreams\n",
+		executeCommand(t, client, []string{"document", "post",
+			"--condition", "music.year==2015",
+			"id:mynamespace:music::a-head-full-of-dreams", "testdata/A-Head-Full-of-Dreams.json"}, []string{}))
+	target := getTarget(documentContext).document
+	expectedPath, _ := vespa.IdToURLPath("id:mynamespace:music::a-head-full-of-dreams")
+	assert.Equal(t, target+"/document/v1/"+expectedPath+"?condition=music.year%3D%3D2015", client.lastRequest.URL.String())
+}
+
+func TestDocumentPostWithCreate(t *testing.T) {
+	client := &mockHttpClient{}
+	assert.Equal(t,
+		"Success: Wrote id:mynamespace:music::a-head-full-of-dreams\n",
+		executeCommand(t, client, []string{"document", "post",
+			"--create",
+			"id:mynamespace:music::a-head-full-of-dreams", "testdata/A-Head-Full-of-Dreams.json"}, []string{}))
+	target := getTarget(documentContext).document
+	expectedPath, _ := vespa.IdToURLPath("id:mynamespace:music::a-head-full-of-dreams")
+	assert.Equal(t, target+"/document/v1/"+expectedPath+"?create=true", client.lastRequest.URL.String())
+}
+
+func TestDocumentConditionFailed(t *testing.T) {
+	assertDocumentError(t, 412, "Condition did not match document")
+}
+
+func TestDocumentFeed(t *testing.T) {
+	client := &mockHttpClient{}
+	assert.Equal(t,
+		"Success: Fed 3 documents\n",
+		executeCommand(t, client, []string{"document", "feed", "--concurrency", "1", "testdata/feed.jsonl"}, []string{}))
+}
+
+// TestDocumentFeedPut, TestDocumentFeedUpdate and TestDocumentFeedRemove each
+// feed a single operation so the method, URL and body feedOperationFrom
+// dispatches for every verb ("put"->POST, "update"->PUT, "remove"->DELETE)
+// can be asserted individually, since the mock client only retains the last
+// request it saw.
+func TestDocumentFeedPut(t *testing.T) {
+	client := &mockHttpClient{}
+	assert.Equal(t,
+		"Success: Fed 1 documents\n",
+		executeCommand(t, client, []string{"document", "feed", "testdata/feed-put.jsonl"}, []string{}))
+	target := getTarget(documentContext).document
+	expectedPath, _ := vespa.IdToURLPath("id:mynamespace:music::a-head-full-of-dreams")
+	assert.Equal(t, target+"/document/v1/"+expectedPath, client.lastRequest.URL.String())
+	assert.Equal(t, "POST", client.lastRequest.Method)
+	assert.Equal(t, "application/json", client.lastRequest.Header.Get("Content-Type"))
+
+	fileContent, _ := ioutil.ReadFile("testdata/feed-put.jsonl")
+	assert.Equal(t, strings.TrimRight(string(fileContent), "\n"), util.ReaderToString(client.lastRequest.Body))
+}
+
+func TestDocumentFeedUpdate(t *testing.T) {
+	client := &mockHttpClient{}
+	assert.Equal(t,
+		"Success: Fed 1 documents\n",
+		executeCommand(t, client, []string{"document", "feed", "testdata/feed-update.jsonl"}, []string{}))
+	target := getTarget(documentContext).document
+	expectedPath, _ := vespa.IdToURLPath("id:mynamespace:music::a-head-full-of-dreams")
+	assert.Equal(t, target+"/document/v1/"+expectedPath, client.lastRequest.URL.String())
+	assert.Equal(t, "PUT", client.lastRequest.Method)
+	assert.Equal(t, "application/json", client.lastRequest.Header.Get("Content-Type"))
+
+	fileContent, _ := ioutil.ReadFile("testdata/feed-update.jsonl")
+	assert.Equal(t, strings.TrimRight(string(fileContent), "\n"), util.ReaderToString(client.lastRequest.Body))
+}
+
+func TestDocumentFeedRemove(t *testing.T) {
+	client := &mockHttpClient{}
+	assert.Equal(t,
+		"Success: Fed 1 documents\n",
+		executeCommand(t, client, []string{"document", "feed", "testdata/feed-remove.jsonl"}, []string{}))
+	target := getTarget(documentContext).document
+	expectedPath, _ := vespa.IdToURLPath("id:mynamespace:music::a-head-full-of-dreams")
+	assert.Equal(t, target+"/document/v1/"+expectedPath, client.lastRequest.URL.String())
+	assert.Equal(t, "DELETE", client.lastRequest.Method)
+}
+
+func TestDocumentGetWithFields(t *testing.T) {
+	client := &mockHttpClient{nextBody: "{\"fields\":{\"foo\":\"bar\"}}"}
+	executeCommand(t, client, []string{"document", "get", "--fields", "foo,bar",
+		"id:mynamespace:music::a-head-full-of-dreams"}, []string{})
+	target := getTarget(documentContext).document
+	expectedPath, _ := vespa.IdToURLPath("id:mynamespace:music::a-head-full-of-dreams")
+	assert.Equal(t, target+"/document/v1/"+expectedPath+"?fieldSet=%5Bname%5D%3Afoo%2Cbar", client.lastRequest.URL.String())
+}
+
+func TestDocumentGetRawFormat(t *testing.T) {
+	client := &mockHttpClient{nextBody: "{\"fields\":{\"foo\":\"bar\"}}"}
+	assert.Equal(t,
+		"{\"fields\":{\"foo\":\"bar\"}}\n",
+		executeCommand(t, client, []string{"document", "get", "--format", "raw",
+			"id:mynamespace:music::a-head-full-of-dreams"}, []string{}))
+}
+
+func TestDocumentGetToFile(t *testing.T) {
+	client := &mockHttpClient{nextBody: "{\"fields\":{\"foo\":\"bar\"}}"}
+	outputFile := t.TempDir() + "/document.json"
+	assert.Equal(t,
+		"Success: Wrote "+outputFile+"\n",
+		executeCommand(t, client, []string{"document", "get", "--output", outputFile,
+			"id:mynamespace:music::a-head-full-of-dreams"}, []string{}))
+	content, err := ioutil.ReadFile(outputFile)
+	assert.Nil(t, err)
+	assert.Equal(t, "{\n    \"fields\": {\n        \"foo\": \"bar\"\n    }\n}\n", string(content))
+}
+
+func TestDocumentPostJsonError(t *testing.T) {
+	client := &mockHttpClient{nextStatus: 401, nextBody: "Document error"}
+	originalErrOut := errOut
+	var captured bytes.Buffer
+	errOut = &captured
+	defer func() { errOut = originalErrOut }()
+
+	exitCode := withCapturedExit(t, func() {
+		executeCommand(t, client, []string{"document", "post", "--json-errors",
+			"id:mynamespace:music::a-head-full-of-dreams",
+			"testdata/A-Head-Full-of-Dreams.json"}, []string{})
+	})
+	assert.Equal(t, 1, exitCode)
+
+	var payload struct {
+		Status     int    `json:"status"`
+		Message    string `json:"message"`
+		DocumentId string `json:"documentId"`
+	}
+	assert.Nil(t, json.Unmarshal(captured.Bytes(), &payload))
+	assert.Equal(t, 401, payload.Status)
+	assert.Equal(t, "id:mynamespace:music::a-head-full-of-dreams", payload.DocumentId)
+	assert.Contains(t, payload.Message, "Document error")
+}
+
+func TestDocumentPostLocalIOErrorExitCode(t *testing.T) {
+	client := &mockHttpClient{}
+	exitCode := withCapturedExit(t, func() {
+		executeCommand(t, client, []string{"document", "post",
+			"id:mynamespace:music::a-head-full-of-dreams", "testdata/does-not-exist.json"}, []string{})
+	})
+	assert.Equal(t, 3, exitCode)
+}
+
+// withCapturedExit runs fn with osExit replaced so a document command's
+// requested exit code can be observed instead of terminating the test binary.
+func withCapturedExit(t *testing.T, fn func()) int {
+	originalExit := osExit
+	exitCode := -1
+	osExit = func(code int) { exitCode = code }
+	defer func() { osExit = originalExit }()
+
+	fn()
+
+	assert.NotEqual(t, -1, exitCode, "expected the command to exit with a status code")
+	return exitCode
+}
+
 func assertDocumentPost(arguments []string, documentId string, jsonFile string, t *testing.T) {
 	client := &mockHttpClient{}
 	assert.Equal(t,
@@ -74,6 +255,32 @@ func assertDocumentPostShortForm(documentId string, jsonFile string, t *testing.
 	assert.Equal(t, target+"/document/v1/"+documentId, client.lastRequest.URL.String())
 }
 
+func assertDocumentPut(arguments []string, documentId string, jsonFile string, t *testing.T) {
+	client := &mockHttpClient{}
+	assert.Equal(t,
+		"Success: Wrote "+documentId+"\n",
+		executeCommand(t, client, arguments, []string{}))
+	target := getTarget(documentContext).document
+	expectedPath, _ := vespa.IdToURLPath(documentId)
+	assert.Equal(t, target+"/document/v1/"+expectedPath, client.lastRequest.URL.String())
+	assert.Equal(t, "application/json", client.lastRequest.Header.Get("Content-Type"))
+	assert.Equal(t, "PUT", client.lastRequest.Method)
+
+	fileContent, _ := ioutil.ReadFile(jsonFile)
+	assert.Equal(t, string(fileContent), util.ReaderToString(client.lastRequest.Body))
+}
+
+func assertDocumentRemove(arguments []string, documentId string, t *testing.T) {
+	client := &mockHttpClient{}
+	assert.Equal(t,
+		"Success: Removed "+documentId+"\n",
+		executeCommand(t, client, arguments, []string{}))
+	target := getTarget(documentContext).document
+	expectedPath, _ := vespa.IdToURLPath(documentId)
+	assert.Equal(t, target+"/document/v1/"+expectedPath, client.lastRequest.URL.String())
+	assert.Equal(t, "DELETE", client.lastRequest.Method)
+}
+
 func assertDocumentGet(arguments []string, documentId string, t *testing.T) {
 	client := &mockHttpClient{
 		nextBody: "{\"fields\":{\"foo\":\"bar\"}}",
@@ -94,18 +301,28 @@ func assertDocumentGet(arguments []string, documentId string, t *testing.T) {
 
 func assertDocumentError(t *testing.T, status int, errorMessage string) {
 	client := &mockHttpClient{nextStatus: status, nextBody: errorMessage}
+	var output string
+	exitCode := withCapturedExit(t, func() {
+		output = executeCommand(t, client, []string{"document", "post",
+			"id:mynamespace:music::a-head-full-of-dreams",
+			"testdata/A-Head-Full-of-Dreams.json"}, []string{})
+	})
 	assert.Equal(t,
 		"Error: Invalid document: Status "+strconv.Itoa(status)+"\n\n"+errorMessage+"\n",
-		executeCommand(t, client, []string{"document", "post",
-			"id:mynamespace:music::a-head-full-of-dreams",
-			"testdata/A-Head-Full-of-Dreams.json"}, []string{}))
+		output)
+	assert.Equal(t, 1, exitCode)
 }
 
 func assertDocumentServerError(t *testing.T, status int, errorMessage string) {
 	client := &mockHttpClient{nextStatus: status, nextBody: errorMessage}
+	var output string
+	exitCode := withCapturedExit(t, func() {
+		output = executeCommand(t, client, []string{"document", "post",
+			"id:mynamespace:music::a-head-full-of-dreams",
+			"testdata/A-Head-Full-of-Dreams.json"}, []string{})
+	})
 	assert.Equal(t,
 		"Error: Container (document API) at 127.0.0.1:8080: Status "+strconv.Itoa(status)+"\n\n"+errorMessage+"\n",
-		executeCommand(t, client, []string{"document", "post",
-			"id:mynamespace:music::a-head-full-of-dreams",
-			"testdata/A-Head-Full-of-Dreams.json"}, []string{}))
+		output)
+	assert.Equal(t, 2, exitCode)
 }